@@ -0,0 +1,101 @@
+package websocket
+
+import (
+	"sync"
+	"time"
+)
+
+// maxPollBacklog bounds how many undelivered events we keep per URN so a
+// client that never comes back to poll can't leak memory.
+const maxPollBacklog = 50
+
+// backlogTTL is how long a URN's backlog can sit untouched before sweep
+// reclaims it, so a channel with contacts that never come back doesn't
+// grow the backlog map forever.
+const backlogTTL = time.Hour
+
+// sweepInterval is how often sweep runs looking for idle backlogs.
+const sweepInterval = 5 * time.Minute
+
+// polledEvent is a single outbound message queued for a long-polling or
+// SSE client, tagged with a monotonically increasing ID so the client can
+// resume from `lastEventId` after a dropped connection.
+type polledEvent struct {
+	ID   int64        `json:"id"`
+	Data *dataPayload `json:"data"`
+}
+
+// backlogStore is the per-URN event backlog shared by longPollRegistry
+// (fetchEvents) and sseRegistry (stream): both need to remember undelivered
+// events per URN, replay them from a given ID, and evict a URN's entry once
+// it's gone idle. Embedding registries hold store.mu themselves so backlog
+// access can be composed with their own bookkeeping (waiters/subs) in a
+// single critical section.
+type backlogStore struct {
+	mu           sync.Mutex
+	nextID       int64
+	backlog      map[string][]*polledEvent
+	lastActivity map[string]time.Time
+}
+
+func newBacklogStore() *backlogStore {
+	return &backlogStore{
+		backlog:      make(map[string][]*polledEvent),
+		lastActivity: make(map[string]time.Time),
+	}
+}
+
+// record appends a new event to urn's backlog, capped at maxPollBacklog,
+// and returns it. Callers must hold mu.
+func (s *backlogStore) record(urn string, payload *dataPayload) *polledEvent {
+	s.nextID++
+	s.lastActivity[urn] = time.Now()
+
+	ev := &polledEvent{ID: s.nextID, Data: payload}
+	events := append(s.backlog[urn], ev)
+	if len(events) > maxPollBacklog {
+		events = events[len(events)-maxPollBacklog:]
+	}
+	s.backlog[urn] = events
+
+	return ev
+}
+
+// pendingSince returns the backlog events for urn with an ID greater than
+// lastEventID. Callers must hold mu.
+func (s *backlogStore) pendingSince(urn string, lastEventID int64) []*polledEvent {
+	all := s.backlog[urn]
+	pending := make([]*polledEvent, 0, len(all))
+	for _, ev := range all {
+		if ev.ID > lastEventID {
+			pending = append(pending, ev)
+		}
+	}
+	return pending
+}
+
+// sweep drops the backlog for any URN that's been idle longer than
+// backlogTTL, unless isActive reports it still has a live listener.
+func (s *backlogStore) sweep(now time.Time, isActive func(urn string) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := now.Add(-backlogTTL)
+	for urn, last := range s.lastActivity {
+		if last.After(cutoff) || isActive(urn) {
+			continue
+		}
+		delete(s.backlog, urn)
+		delete(s.lastActivity, urn)
+	}
+}
+
+// sweepLoop calls sweep every sweepInterval until the process exits.
+func sweepLoop(sweep func(now time.Time)) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sweep(time.Now())
+	}
+}
@@ -0,0 +1,136 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	. "github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/handlers"
+	"github.com/nyaruka/gocommon/urns"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = (wsPongWait * 9) / 10
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// connect upgrades the request to a WebSocket connection for the contact
+// identified by the `urn` query param, then holds the socket open for the
+// lifetime of the connection, dispatching inbound frames through the same
+// pipeline as the HTTP register/receive endpoints.
+func (h *handler) connect(ctx context.Context, channel Channel, w http.ResponseWriter, r *http.Request) ([]Event, error) {
+	urnPath := r.URL.Query().Get("urn")
+	if urnPath == "" {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, fmt.Errorf("missing urn query param"))
+	}
+
+	urn, err := urns.NewURNFromParts(channel.Schemes()[0], urnPath, "", "")
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+
+	raw, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+	conn := newSafeConn(raw)
+
+	// a client that reconnects replaces its old socket here; close the
+	// stale one instead of leaking it until its own pong timeout fires
+	if old := h.conns.add(urn.String(), conn); old != nil {
+		old.Close()
+	}
+	h.logWSLifecycle(channel, "WebSocket Connected", nil)
+
+	go h.servePump(channel, urn, conn)
+
+	return nil, nil
+}
+
+// servePump owns conn for its whole life: it replies to pings, reads
+// inbound frames off the wire and keeps the connection alive with periodic
+// pings of its own, cleaning up the registry when the socket goes away.
+func (h *handler) servePump(channel Channel, urn urns.URN, conn *safeConn) {
+	defer func() {
+		h.conns.remove(urn.String(), conn)
+		conn.Close()
+		h.logWSLifecycle(channel, "WebSocket Disconnected", nil)
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		return nil
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			_, raw, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			h.handleWSFrame(channel, raw)
+		}
+	}()
+
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handleWSFrame decodes a single inbound frame as either a moPayload
+// (messages/acks) or a userPayload (registration), reusing the same
+// processing used by the HTTP endpoints.
+func (h *handler) handleWSFrame(channel Channel, raw []byte) {
+	ctx := context.Background()
+
+	mo := &moPayload{}
+	if err := json.Unmarshal(raw, mo); err == nil && (len(mo.Messages) > 0 || len(mo.Ack) > 0) {
+		if _, _, err := h.processMoPayload(ctx, channel, mo); err != nil {
+			h.logWSLifecycle(channel, "Error Processing Message", err)
+		}
+		return
+	}
+
+	up := &userPayload{}
+	if err := json.Unmarshal(raw, up); err == nil && up.URN != "" {
+		if _, err := h.processUserPayload(ctx, channel, up); err != nil {
+			h.logWSLifecycle(channel, "Error Processing Registration", err)
+		}
+		return
+	}
+
+	h.logWSLifecycle(channel, "Unrecognized Frame", fmt.Errorf("could not parse frame: %s", string(raw)))
+}
+
+// logWSLifecycle records a socket lifecycle event (connect, disconnect,
+// frame errors) on the channel's logs, the same way HTTP requests are
+// logged by handlers.WriteAndLogRequestError.
+func (h *handler) logWSLifecycle(channel Channel, description string, err error) {
+	log := NewChannelLog(description, channel, NilMsgID, "", "", NilStatusCode, "", "", time.Duration(0), err)
+	h.Backend().WriteChannelLogs(context.Background(), []*ChannelLog{log})
+}
@@ -0,0 +1,49 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	. "github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/handlers"
+	"github.com/nyaruka/gocommon/urns"
+)
+
+const defaultPollTime = 30 * time.Second
+
+// fetchEvents is a long-poll fallback for clients that can't hold open a
+// WebSocket: it returns the events queued for `urn` that are newer than
+// `lastEventId` (so a client can resume after a dropped poll) as the same
+// JSON shape used elsewhere. If there are none yet, it first blocks for up
+// to `pollTime` seconds waiting for SendMsg to queue one.
+func (h *handler) fetchEvents(ctx context.Context, channel Channel, w http.ResponseWriter, r *http.Request) ([]Event, error) {
+	urnPath := r.URL.Query().Get("urn")
+	if urnPath == "" {
+		return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "Ignoring request, no identifier")
+	}
+
+	urn, err := urns.NewURNFromParts(channel.Schemes()[0], urnPath, "", "")
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+
+	lastEventID, _ := strconv.ParseInt(r.URL.Query().Get("lastEventId"), 10, 64)
+
+	pollTime := defaultPollTime
+	if raw := r.URL.Query().Get("pollTime"); raw != "" {
+		if secs, err := strconv.Atoi(raw); err == nil && secs > 0 {
+			pollTime = time.Duration(secs) * time.Second
+		}
+	}
+
+	events := h.polls.wait(ctx.Done(), urn.String(), lastEventID, pollTime)
+
+	data := make([]interface{}, len(events))
+	for i, ev := range events {
+		data[i] = ev
+	}
+
+	return nil, WriteDataResponse(ctx, w, http.StatusOK, "Events Handled", data)
+}
@@ -0,0 +1,80 @@
+package websocket
+
+import (
+	"time"
+)
+
+// longPollRegistry tracks clients that are long-polling for events on a
+// given URN (via fetchEvents) and the backlog of events queued for them
+// by SendMsg while no poll is outstanding.
+type longPollRegistry struct {
+	store   *backlogStore
+	waiters map[string]chan struct{}
+}
+
+func newLongPollRegistry() *longPollRegistry {
+	r := &longPollRegistry{
+		store:   newBacklogStore(),
+		waiters: make(map[string]chan struct{}),
+	}
+	go sweepLoop(func(now time.Time) { r.store.sweep(now, r.hasWaiter) })
+	return r
+}
+
+// hasWaiter reports whether urn currently has a long-poll outstanding.
+// Callers must hold r.store.mu.
+func (r *longPollRegistry) hasWaiter(urn string) bool {
+	_, ok := r.waiters[urn]
+	return ok
+}
+
+// enqueue records payload as a new event for urn and wakes up any
+// outstanding long-poll. It returns false if there is no long-poll
+// waiting for this URN, so the caller can fall back to the HTTP POST
+// transport instead.
+func (r *longPollRegistry) enqueue(urn string, payload *dataPayload) bool {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	signal, waiting := r.waiters[urn]
+	r.store.record(urn, payload)
+
+	if !waiting {
+		return false
+	}
+
+	select {
+	case signal <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// wait returns every backlog event for urn newer than lastEventID. If
+// there are none yet, it first blocks until a new event is queued for
+// urn, pollTime elapses or done fires.
+func (r *longPollRegistry) wait(done <-chan struct{}, urn string, lastEventID int64, pollTime time.Duration) []*polledEvent {
+	r.store.mu.Lock()
+	signal := make(chan struct{}, 1)
+	r.waiters[urn] = signal
+	pending := r.store.pendingSince(urn, lastEventID)
+	r.store.mu.Unlock()
+
+	if len(pending) == 0 {
+		timer := time.NewTimer(pollTime)
+		defer timer.Stop()
+
+		select {
+		case <-signal:
+		case <-timer.C:
+		case <-done:
+		}
+	}
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+	if r.waiters[urn] == signal {
+		delete(r.waiters, urn)
+	}
+	return r.store.pendingSince(urn, lastEventID)
+}
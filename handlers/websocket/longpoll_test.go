@@ -0,0 +1,98 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLongPollRegistryEnqueueAndWait(t *testing.T) {
+	r := newLongPollRegistry()
+
+	// nothing waiting yet, so enqueue just banks the event and reports that
+	// no one was waiting
+	if r.enqueue("tel:+1234", &dataPayload{Text: "hi"}) {
+		t.Fatal("expected enqueue to report no waiter")
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	events := r.wait(done, "tel:+1234", 0, time.Second)
+	if len(events) != 1 || events[0].Data.Text != "hi" {
+		t.Fatalf("expected backlog to be replayed to a fresh wait, got %v", events)
+	}
+
+	// waiting again from the last seen ID should block until timeout
+	start := time.Now()
+	events = r.wait(done, "tel:+1234", events[0].ID, 50*time.Millisecond)
+	if len(events) != 0 {
+		t.Fatalf("expected no new events, got %v", events)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("expected wait to block for the poll timeout")
+	}
+}
+
+func TestLongPollRegistryEnqueueWakesWaiter(t *testing.T) {
+	r := newLongPollRegistry()
+	done := make(chan struct{})
+	defer close(done)
+
+	resultCh := make(chan []*polledEvent, 1)
+	go func() {
+		resultCh <- r.wait(done, "tel:+5678", 0, 5*time.Second)
+	}()
+
+	// give the goroutine a chance to register as a waiter
+	time.Sleep(10 * time.Millisecond)
+
+	if !r.enqueue("tel:+5678", &dataPayload{Text: "hey"}) {
+		t.Fatal("expected enqueue to find a waiter")
+	}
+
+	select {
+	case events := <-resultCh:
+		if len(events) != 1 || events[0].Data.Text != "hey" {
+			t.Fatalf("expected the enqueued event to be delivered, got %v", events)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait never woke up after enqueue")
+	}
+}
+
+func TestLongPollRegistrySweepReclaimsIdleBacklog(t *testing.T) {
+	r := newLongPollRegistry()
+	r.enqueue("tel:+9999", &dataPayload{Text: "stale"})
+
+	r.store.sweep(time.Now().Add(2*backlogTTL), r.hasWaiter)
+
+	r.store.mu.Lock()
+	_, hasBacklog := r.store.backlog["tel:+9999"]
+	_, hasActivity := r.store.lastActivity["tel:+9999"]
+	r.store.mu.Unlock()
+
+	if hasBacklog || hasActivity {
+		t.Fatal("expected sweep to reclaim the idle backlog")
+	}
+}
+
+func TestLongPollRegistrySweepSparesActiveWaiter(t *testing.T) {
+	r := newLongPollRegistry()
+	r.enqueue("tel:+1111", &dataPayload{Text: "still going"})
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go r.wait(done, "tel:+1111", 999, time.Second)
+	time.Sleep(10 * time.Millisecond)
+
+	r.store.sweep(time.Now().Add(2*backlogTTL), r.hasWaiter)
+
+	r.store.mu.Lock()
+	_, hasBacklog := r.store.backlog["tel:+1111"]
+	r.store.mu.Unlock()
+
+	if !hasBacklog {
+		t.Fatal("expected sweep to spare the backlog for a URN with a live waiter")
+	}
+}
@@ -0,0 +1,367 @@
+package websocket
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+
+	. "github.com/nyaruka/courier"
+)
+
+// outboundPriority orders queued sends: status updates before plain text,
+// and both before bulk/broadcast sends.
+type outboundPriority int
+
+const (
+	priorityStatus outboundPriority = iota
+	priorityText
+	priorityBulk
+)
+
+// outboundBackoff is the delay before each retry, stepping up to
+// maxOutboundBackoff once the schedule runs out.
+var outboundBackoff = []time.Duration{
+	1 * time.Second,
+	5 * time.Second,
+	30 * time.Second,
+	2 * time.Minute,
+	10 * time.Minute,
+}
+
+const maxOutboundBackoff = time.Hour
+
+// defaultMaxSendAttempts is used when a channel doesn't configure
+// "max_send_attempts".
+const defaultMaxSendAttempts = 10
+
+// backoffForAttempt returns how long to wait before retrying a send that
+// has already failed `attempt` times. attempt 0 (not yet retried) and
+// attempt 1 (failed once) both get the first backoff step.
+func backoffForAttempt(attempt int) time.Duration {
+	idx := attempt - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx < len(outboundBackoff) {
+		return outboundBackoff[idx]
+	}
+	return maxOutboundBackoff
+}
+
+// priorityForMsg buckets msg the way the queue orders sends.
+func priorityForMsg(msg Msg) outboundPriority {
+	if msg.HighPriority() {
+		return priorityStatus
+	}
+	if msg.Text() != "" {
+		return priorityText
+	}
+	return priorityBulk
+}
+
+// outboundJob is a single queued send, ordered first by when it's next
+// due and then by priority. It only keeps the channel and message ID (not
+// the full Msg) so a job can be rebuilt from persisted state on restart
+// without needing to reconstruct a Msg.
+type outboundJob struct {
+	channel    Channel
+	msgID      MsgID
+	address    string
+	data       *dataPayload
+	priority   outboundPriority
+	attempt    int
+	nextAt     time.Time
+	enqueuedAt time.Time
+
+	index int // maintained by container/heap
+}
+
+// outboundJobHeap is a min-heap of outboundJobs ordered by (nextAt, priority).
+type outboundJobHeap []*outboundJob
+
+func (h outboundJobHeap) Len() int { return len(h) }
+
+func (h outboundJobHeap) Less(i, j int) bool {
+	if !h[i].nextAt.Equal(h[j].nextAt) {
+		return h[i].nextAt.Before(h[j].nextAt)
+	}
+	return h[i].priority < h[j].priority
+}
+
+func (h outboundJobHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *outboundJobHeap) Push(x interface{}) {
+	job := x.(*outboundJob)
+	job.index = len(*h)
+	*h = append(*h, job)
+}
+
+func (h *outboundJobHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	job := old[n-1]
+	old[n-1] = nil
+	job.index = -1
+	*h = old[:n-1]
+	return job
+}
+
+// PersistedOutboundJob is the durable representation of one outboundJob,
+// as handed to and returned from an outboundPersister.
+type PersistedOutboundJob struct {
+	Channel    Channel
+	MsgID      MsgID
+	Address    string
+	Data       *dataPayload
+	Priority   outboundPriority
+	Attempt    int
+	NextAt     time.Time
+	EnqueuedAt time.Time
+}
+
+// outboundPersister is the persistence a Backend can optionally provide
+// for the outbound retry queue, so a process restart doesn't drop queued
+// messages. Backends that don't implement it still work, just in-memory
+// only: ListPendingOutbound is consulted once, when a queue for an
+// address is first created, to reload anything left over from before.
+type outboundPersister interface {
+	EnqueueOutbound(ctx context.Context, address string, job PersistedOutboundJob) error
+	DequeueOutbound(ctx context.Context, address string, msgID MsgID) error
+	AckOutbound(ctx context.Context, address string, msgID MsgID) error
+	ListPendingOutbound(ctx context.Context, address string) ([]PersistedOutboundJob, error)
+}
+
+func (j *outboundJob) persisted() PersistedOutboundJob {
+	return PersistedOutboundJob{
+		Channel:    j.channel,
+		MsgID:      j.msgID,
+		Address:    j.address,
+		Data:       j.data,
+		Priority:   j.priority,
+		Attempt:    j.attempt,
+		NextAt:     j.nextAt,
+		EnqueuedAt: j.enqueuedAt,
+	}
+}
+
+func jobFromPersisted(p PersistedOutboundJob) *outboundJob {
+	return &outboundJob{
+		channel:    p.Channel,
+		msgID:      p.MsgID,
+		address:    p.Address,
+		data:       p.Data,
+		priority:   p.Priority,
+		attempt:    p.Attempt,
+		enqueuedAt: p.EnqueuedAt,
+		nextAt:     p.NextAt,
+	}
+}
+
+// outboundQueue is the per-channel-address retry queue for outbound
+// sends: a min-heap, persisted through the backend's outboundPersister
+// (if it has one) so a restart doesn't drop messages, drained by a
+// single worker goroutine so retries for the same address stay ordered.
+type outboundQueue struct {
+	h    *handler
+	addr string
+
+	mu      sync.Mutex
+	pending outboundJobHeap
+	notify  chan struct{}
+
+	startOnce sync.Once
+}
+
+func newOutboundQueue(h *handler, addr string) *outboundQueue {
+	q := &outboundQueue{h: h, addr: addr, notify: make(chan struct{}, 1)}
+	q.reload()
+	return q
+}
+
+// reload pulls back anything a prior process instance had persisted for
+// this address, so restarts don't silently drop queued sends.
+func (q *outboundQueue) reload() {
+	persister, ok := q.h.Backend().(outboundPersister)
+	if !ok {
+		return
+	}
+
+	jobs, err := persister.ListPendingOutbound(context.Background(), q.addr)
+	if err != nil || len(jobs) == 0 {
+		return
+	}
+
+	q.mu.Lock()
+	for _, p := range jobs {
+		heap.Push(&q.pending, jobFromPersisted(p))
+	}
+	q.mu.Unlock()
+
+	q.startOnce.Do(func() { go q.run() })
+}
+
+// enqueue adds job to the queue (persisting it via the backend, if it
+// supports that) and starts the worker goroutine the first time it's
+// called for this queue.
+func (q *outboundQueue) enqueue(job *outboundJob) {
+	q.mu.Lock()
+	heap.Push(&q.pending, job)
+	q.mu.Unlock()
+
+	if persister, ok := q.h.Backend().(outboundPersister); ok {
+		persister.EnqueueOutbound(context.Background(), q.addr, job.persisted())
+	}
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+
+	q.startOnce.Do(func() { go q.run() })
+}
+
+// depth is the number of sends currently queued or awaiting retry.
+func (q *outboundQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// oldestAge is how long the oldest queued send has been waiting since it
+// was first enqueued. It's based on enqueuedAt rather than nextAt, since
+// nextAt is pushed into the future on every backoff reschedule and would
+// make a job in retry-backoff look younger than it is (or even negative).
+func (q *outboundQueue) oldestAge() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.pending) == 0 {
+		return 0
+	}
+
+	oldest := q.pending[0].enqueuedAt
+	for _, job := range q.pending {
+		if job.enqueuedAt.Before(oldest) {
+			oldest = job.enqueuedAt
+		}
+	}
+	return time.Since(oldest)
+}
+
+// run is the worker loop for this address: it waits for the next job to
+// become due, sends it, and reschedules or acks depending on the result.
+func (q *outboundQueue) run() {
+	for {
+		q.mu.Lock()
+		if len(q.pending) == 0 {
+			q.mu.Unlock()
+			<-q.notify
+			continue
+		}
+		nextAt := q.pending[0].nextAt
+		q.mu.Unlock()
+
+		if wait := time.Until(nextAt); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-q.notify:
+			}
+			continue
+		}
+
+		q.mu.Lock()
+		job := heap.Pop(&q.pending).(*outboundJob)
+		q.mu.Unlock()
+
+		q.process(job)
+	}
+}
+
+// process sends job, then marks it sent/failed or reschedules it with
+// backoff depending on the outcome.
+func (q *outboundQueue) process(job *outboundJob) {
+	ctx := context.Background()
+	backend := q.h.Backend()
+
+	externalID, statusCode, log, err := q.h.sendMsgPart(job.channel, job.msgID, job.address, job.data)
+
+	status := backend.NewMsgStatusForID(job.channel, job.msgID, MsgErrored)
+	status.SetExternalID(externalID)
+	status.AddLog(log)
+
+	ackAndWrite := func(finalStatus MsgStatusValue) {
+		status.SetStatus(finalStatus)
+		backend.WriteMsgStatus(ctx, status)
+		if persister, ok := backend.(outboundPersister); ok {
+			persister.AckOutbound(ctx, q.addr, job.msgID)
+		}
+	}
+
+	switch {
+	case err == nil && statusCode >= 200 && statusCode < 300:
+		ackAndWrite(MsgSent)
+		return
+
+	case statusCode >= 400 && statusCode < 500:
+		// client error, retrying won't help
+		ackAndWrite(MsgFailed)
+		return
+	}
+
+	// 5xx, timeout, or any other transport error: retry with backoff
+	maxAttempts := defaultMaxSendAttempts
+	if configured, ok := job.channel.ConfigForKey("max_send_attempts", defaultMaxSendAttempts).(int); ok && configured > 0 {
+		maxAttempts = configured
+	}
+
+	job.attempt++
+	if job.attempt >= maxAttempts {
+		ackAndWrite(MsgFailed)
+		return
+	}
+
+	job.nextAt = time.Now().Add(backoffForAttempt(job.attempt))
+	if persister, ok := backend.(outboundPersister); ok {
+		persister.DequeueOutbound(ctx, q.addr, job.msgID)
+	}
+	q.enqueue(job)
+}
+
+// queueFor returns (creating and reloading it, if necessary) the
+// outbound queue for addr.
+func (h *handler) queueFor(addr string) *outboundQueue {
+	h.queuesMu.Lock()
+	defer h.queuesMu.Unlock()
+
+	q, ok := h.queues[addr]
+	if !ok {
+		q = newOutboundQueue(h, addr)
+		h.queues[addr] = q
+	}
+	return q
+}
+
+// QueueMetric is the depth and oldest-item age of one channel address's
+// outbound queue, surfaced alongside this handler's other metrics.
+type QueueMetric struct {
+	Depth     int
+	OldestAge time.Duration
+}
+
+// QueueMetrics reports outbound queue depth and oldest-item age per
+// channel address, for the existing metrics surface to scrape.
+func (h *handler) QueueMetrics() map[string]QueueMetric {
+	h.queuesMu.Lock()
+	defer h.queuesMu.Unlock()
+
+	metrics := make(map[string]QueueMetric, len(h.queues))
+	for addr, q := range h.queues {
+		metrics[addr] = QueueMetric{Depth: q.depth(), OldestAge: q.oldestAge()}
+	}
+	return metrics
+}
@@ -0,0 +1,57 @@
+package websocket
+
+import (
+	"container/heap"
+	"testing"
+	"time"
+)
+
+func TestBackoffForAttempt(t *testing.T) {
+	tests := []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{0, 1 * time.Second},
+		{1, 1 * time.Second},
+		{2, 5 * time.Second},
+		{3, 30 * time.Second},
+		{4, 2 * time.Minute},
+		{5, 10 * time.Minute},
+		{6, time.Hour},
+		{100, time.Hour},
+	}
+
+	for _, tc := range tests {
+		if got := backoffForAttempt(tc.attempt); got != tc.expected {
+			t.Errorf("backoffForAttempt(%d) = %v, expected %v", tc.attempt, got, tc.expected)
+		}
+	}
+}
+
+func TestOutboundJobHeapOrdering(t *testing.T) {
+	now := time.Now()
+
+	var h outboundJobHeap
+	heap.Init(&h)
+
+	heap.Push(&h, &outboundJob{address: "late-bulk", priority: priorityBulk, nextAt: now.Add(time.Minute)})
+	heap.Push(&h, &outboundJob{address: "due-text", priority: priorityText, nextAt: now})
+	heap.Push(&h, &outboundJob{address: "due-status", priority: priorityStatus, nextAt: now})
+	heap.Push(&h, &outboundJob{address: "due-bulk", priority: priorityBulk, nextAt: now})
+
+	// among jobs due at the same time, higher priority (lower value) goes first
+	if got := heap.Pop(&h).(*outboundJob); got.address != "due-status" {
+		t.Fatalf("expected due-status first, got %s", got.address)
+	}
+	if got := heap.Pop(&h).(*outboundJob); got.address != "due-text" {
+		t.Fatalf("expected due-text second, got %s", got.address)
+	}
+	if got := heap.Pop(&h).(*outboundJob); got.address != "due-bulk" {
+		t.Fatalf("expected due-bulk third, got %s", got.address)
+	}
+
+	// a job that isn't due yet sorts after every job that is due
+	if got := heap.Pop(&h).(*outboundJob); got.address != "late-bulk" {
+		t.Fatalf("expected late-bulk last, got %s", got.address)
+	}
+}
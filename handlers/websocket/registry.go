@@ -0,0 +1,100 @@
+package websocket
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// safeConn wraps a *websocket.Conn so that SendMsg (writing outbound
+// messages) and servePump's ping ticker (writing control frames) can
+// never both be in the middle of a write at once — gorilla/websocket
+// only allows a single concurrent writer per connection. Reads aren't
+// guarded since each connection only ever has the one reader goroutine
+// started by servePump.
+type safeConn struct {
+	conn *websocket.Conn
+
+	writeMu sync.Mutex
+}
+
+func newSafeConn(conn *websocket.Conn) *safeConn {
+	return &safeConn{conn: conn}
+}
+
+func (c *safeConn) WriteJSON(v interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteJSON(v)
+}
+
+func (c *safeConn) WriteMessage(messageType int, data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.WriteMessage(messageType, data)
+}
+
+func (c *safeConn) SetWriteDeadline(t time.Time) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *safeConn) ReadMessage() (int, []byte, error) {
+	return c.conn.ReadMessage()
+}
+
+func (c *safeConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *safeConn) SetPongHandler(h func(string) error) {
+	c.conn.SetPongHandler(h)
+}
+
+func (c *safeConn) Close() error {
+	return c.conn.Close()
+}
+
+// connRegistry tracks the live WebSocket connection for each URN so that
+// SendMsg can push directly to a connected client instead of always
+// falling back to an HTTP POST against the channel address.
+type connRegistry struct {
+	mu    sync.Mutex
+	conns map[string]*safeConn
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{conns: make(map[string]*safeConn)}
+}
+
+// add registers conn as the current socket for urn and returns whatever
+// connection it replaces (nil if there wasn't one), so the caller can
+// close the stale connection instead of leaking it until its own pong
+// timeout fires.
+func (r *connRegistry) add(urn string, conn *safeConn) *safeConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old := r.conns[urn]
+	r.conns[urn] = conn
+	return old
+}
+
+// remove drops conn from the registry, but only if it is still the
+// current connection for urn (a newer reconnect may have replaced it).
+func (r *connRegistry) remove(urn string, conn *safeConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if existing := r.conns[urn]; existing == conn {
+		delete(r.conns, urn)
+	}
+}
+
+// get returns the live connection for urn, or nil if there isn't one.
+func (r *connRegistry) get(urn string) *safeConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.conns[urn]
+}
@@ -0,0 +1,40 @@
+package websocket
+
+import "testing"
+
+func TestConnRegistry(t *testing.T) {
+	r := newConnRegistry()
+
+	if got := r.get("urn1"); got != nil {
+		t.Fatalf("expected no connection for urn1, got %v", got)
+	}
+
+	first := newSafeConn(nil)
+	if old := r.add("urn1", first); old != nil {
+		t.Fatalf("expected no previous connection, got %v", old)
+	}
+	if got := r.get("urn1"); got != first {
+		t.Fatalf("expected %v, got %v", first, got)
+	}
+
+	// reconnecting should hand back the stale connection so the caller
+	// can close it, and take over as the current one
+	second := newSafeConn(nil)
+	if old := r.add("urn1", second); old != first {
+		t.Fatalf("expected add to return the replaced connection %v, got %v", first, old)
+	}
+	if got := r.get("urn1"); got != second {
+		t.Fatalf("expected %v, got %v", second, got)
+	}
+
+	// removing a now-stale reference must not touch the current connection
+	r.remove("urn1", first)
+	if got := r.get("urn1"); got != second {
+		t.Fatalf("remove of stale conn should not have removed %v, got %v", second, got)
+	}
+
+	r.remove("urn1", second)
+	if got := r.get("urn1"); got != nil {
+		t.Fatalf("expected no connection after remove, got %v", got)
+	}
+}
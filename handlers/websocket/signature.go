@@ -0,0 +1,42 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+
+	. "github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/handlers"
+)
+
+// configSecret is the channel config key operators set to turn on HMAC
+// signature verification for this channel's inbound webhooks.
+const configSecret = "secret"
+
+// routeHandlerFunc is the function signature AddHandlerRoute expects. It's
+// a type alias (not a defined type) so values of this type remain
+// assignable to whatever named func type AddHandlerRoute itself declares.
+type routeHandlerFunc = func(context.Context, Channel, http.ResponseWriter, *http.Request) ([]Event, error)
+
+// withSignatureVerification wraps next so that, if the channel has a
+// "secret" configured, the request must carry a valid HMAC signature (see
+// handlers.VerifyHMACSignature) or it is rejected before next ever runs.
+// Channels without a secret configured are passed through unchanged, so
+// signing stays optional.
+func (h *handler) withSignatureVerification(next routeHandlerFunc) routeHandlerFunc {
+	return func(ctx context.Context, channel Channel, w http.ResponseWriter, r *http.Request) ([]Event, error) {
+		secret, _ := channel.ConfigForKey(configSecret, "").(string)
+		if secret == "" {
+			return next(ctx, channel, w, r)
+		}
+
+		body, err := handlers.VerifyHMACSignature(r, secret)
+		if err != nil {
+			return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		return next(ctx, channel, w, r)
+	}
+}
@@ -0,0 +1,81 @@
+package websocket
+
+import (
+	"time"
+)
+
+// sseRegistry is the pub/sub registry backing the "stream" SSE transport:
+// each URN can have any number of live subscribers, plus a bounded
+// backlog so a reconnecting client can replay events it missed using
+// Last-Event-ID.
+type sseRegistry struct {
+	store *backlogStore
+	subs  map[string]map[chan *polledEvent]bool
+}
+
+func newSSERegistry() *sseRegistry {
+	r := &sseRegistry{
+		store: newBacklogStore(),
+		subs:  make(map[string]map[chan *polledEvent]bool),
+	}
+	go sweepLoop(func(now time.Time) { r.store.sweep(now, r.hasSubscriber) })
+	return r
+}
+
+// hasSubscriber reports whether urn currently has a live SSE subscriber.
+// Callers must hold r.store.mu.
+func (r *sseRegistry) hasSubscriber(urn string) bool {
+	return len(r.subs[urn]) > 0
+}
+
+// subscribe registers a new listener for urn and returns the channel it
+// should read events from. Callers must unsubscribe when done.
+func (r *sseRegistry) subscribe(urn string) chan *polledEvent {
+	ch := make(chan *polledEvent, 16)
+
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	if r.subs[urn] == nil {
+		r.subs[urn] = make(map[chan *polledEvent]bool)
+	}
+	r.subs[urn][ch] = true
+	return ch
+}
+
+// unsubscribe reaps a disconnected listener.
+func (r *sseRegistry) unsubscribe(urn string, ch chan *polledEvent) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	delete(r.subs[urn], ch)
+	if len(r.subs[urn]) == 0 {
+		delete(r.subs, urn)
+	}
+}
+
+// publish records payload as a new event for urn and fans it out to every
+// live subscriber without blocking on a slow reader.
+func (r *sseRegistry) publish(urn string, payload *dataPayload) {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	ev := r.store.record(urn, payload)
+
+	for ch := range r.subs[urn] {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// replay returns the backlogged events for urn newer than lastEventID, so
+// a subscriber resuming with Last-Event-ID doesn't miss anything that was
+// published while it was disconnected.
+func (r *sseRegistry) replay(urn string, lastEventID int64) []*polledEvent {
+	r.store.mu.Lock()
+	defer r.store.mu.Unlock()
+
+	return r.store.pendingSince(urn, lastEventID)
+}
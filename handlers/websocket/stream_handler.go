@@ -0,0 +1,81 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	. "github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/handlers"
+	"github.com/nyaruka/gocommon/urns"
+)
+
+const sseKeepAlive = 30 * time.Second
+const sseRetry = 3 * time.Second
+
+// stream is a Server-Sent Events subscription for the messages outbound
+// to a given URN, for clients that want push without a full WebSocket.
+// It honours Last-Event-ID to replay anything missed across a reconnect
+// and reaps itself from the registry once the client disconnects.
+func (h *handler) stream(ctx context.Context, channel Channel, w http.ResponseWriter, r *http.Request) ([]Event, error) {
+	urnPath := r.URL.Query().Get("urn")
+	if urnPath == "" {
+		return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "Ignoring request, no identifier")
+	}
+
+	urn, err := urns.NewURNFromParts(channel.Schemes()[0], urnPath, "", "")
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, fmt.Errorf("streaming not supported"))
+	}
+
+	var lastEventID int64
+	if raw := r.Header.Get("Last-Event-ID"); raw != "" {
+		lastEventID, _ = strconv.ParseInt(raw, 10, 64)
+	}
+
+	ch := h.streams.subscribe(urn.String())
+	defer h.streams.unsubscribe(urn.String(), ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry/time.Millisecond)
+
+	for _, ev := range h.streams.replay(urn.String(), lastEventID) {
+		writeSSEEvent(w, ev)
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case ev := <-ch:
+			writeSSEEvent(w, ev)
+			flusher.Flush()
+
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+
+		case <-r.Context().Done():
+			return nil, nil
+		}
+	}
+}
+
+// writeSSEEvent writes ev to w in the standard SSE id:/event:/data: framing.
+func writeSSEEvent(w http.ResponseWriter, ev *polledEvent) {
+	body, _ := json.Marshal(ev.Data)
+	fmt.Fprintf(w, "id: %d\nevent: message\ndata: %s\n\n", ev.ID, body)
+}
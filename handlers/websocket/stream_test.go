@@ -0,0 +1,78 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSSERegistryPublishAndReplay(t *testing.T) {
+	r := newSSERegistry()
+
+	ch := r.subscribe("tel:+1234")
+	defer r.unsubscribe("tel:+1234", ch)
+
+	r.publish("tel:+1234", &dataPayload{Text: "hi"})
+
+	select {
+	case ev := <-ch:
+		if ev.Data.Text != "hi" {
+			t.Fatalf("expected published event to reach the subscriber, got %v", ev.Data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscriber never received the published event")
+	}
+
+	replayed := r.replay("tel:+1234", 0)
+	if len(replayed) != 1 || replayed[0].Data.Text != "hi" {
+		t.Fatalf("expected replay to return the backlogged event, got %v", replayed)
+	}
+}
+
+func TestSSERegistryUnsubscribeReapsSubs(t *testing.T) {
+	r := newSSERegistry()
+
+	ch := r.subscribe("tel:+5678")
+	r.unsubscribe("tel:+5678", ch)
+
+	r.store.mu.Lock()
+	_, ok := r.subs["tel:+5678"]
+	r.store.mu.Unlock()
+
+	if ok {
+		t.Fatal("expected unsubscribe to reap the empty subs entry")
+	}
+}
+
+func TestSSERegistrySweepReclaimsIdleBacklog(t *testing.T) {
+	r := newSSERegistry()
+	r.publish("tel:+9999", &dataPayload{Text: "stale"})
+
+	r.store.sweep(time.Now().Add(2*backlogTTL), r.hasSubscriber)
+
+	r.store.mu.Lock()
+	_, hasBacklog := r.store.backlog["tel:+9999"]
+	_, hasActivity := r.store.lastActivity["tel:+9999"]
+	r.store.mu.Unlock()
+
+	if hasBacklog || hasActivity {
+		t.Fatal("expected sweep to reclaim the idle backlog")
+	}
+}
+
+func TestSSERegistrySweepSparesLiveSubscriber(t *testing.T) {
+	r := newSSERegistry()
+	r.publish("tel:+1111", &dataPayload{Text: "still going"})
+
+	ch := r.subscribe("tel:+1111")
+	defer r.unsubscribe("tel:+1111", ch)
+
+	r.store.sweep(time.Now().Add(2*backlogTTL), r.hasSubscriber)
+
+	r.store.mu.Lock()
+	_, hasBacklog := r.store.backlog["tel:+1111"]
+	r.store.mu.Unlock()
+
+	if !hasBacklog {
+		t.Fatal("expected sweep to spare the backlog for a URN with a live subscriber")
+	}
+}
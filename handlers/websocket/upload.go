@@ -0,0 +1,97 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	. "github.com/nyaruka/courier"
+	"github.com/nyaruka/courier/handlers"
+)
+
+// maxUploadSize caps the size of a single media upload accepted by the
+// "upload" route.
+const maxUploadSize = 20 << 20
+
+// attachmentTypes are the message types we treat as attachments rather
+// than plain text, matching what the "upload" route hands back as `type`.
+var attachmentTypes = map[string]bool{
+	"image":    true,
+	"video":    true,
+	"audio":    true,
+	"document": true,
+}
+
+// attachmentStorer is the persistence a Backend must provide for media
+// uploaded through the "upload" route (e.g. S3), returning a URL clients
+// can fetch the file back from. There's no local-disk fallback: this
+// handler has no route serving such files back, so a fallback would hand
+// clients a staticUrl that 404s.
+type attachmentStorer interface {
+	SaveAttachment(ctx context.Context, channel Channel, filename string, contentType string, file io.Reader) (string, error)
+}
+
+// uploadFile accepts a multipart/form-data file, stores it through the
+// backend's attachment storage and hands back a static URL the caller can
+// pass straight back as a message attachment, so clients never need to
+// host media themselves.
+func (h *handler) uploadFile(ctx context.Context, channel Channel, w http.ResponseWriter, r *http.Request) ([]Event, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+
+	if err := r.ParseMultipartForm(maxUploadSize); err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+	defer file.Close()
+
+	contentType := header.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	staticURL, err := h.saveAttachment(ctx, channel, header.Filename, contentType, file)
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
+
+	data := map[string]interface{}{
+		"staticUrl": staticURL,
+		"type":      attachmentTypeForContentType(contentType),
+		"size":      header.Size,
+	}
+
+	return nil, WriteDataResponse(ctx, w, http.StatusOK, "Upload Handled", []interface{}{data})
+}
+
+// saveAttachment stores file through the backend's attachmentStorer,
+// returning an error if the backend doesn't provide one: without real
+// storage there's nowhere to serve the uploaded file back from.
+func (h *handler) saveAttachment(ctx context.Context, channel Channel, filename string, contentType string, file io.Reader) (string, error) {
+	storer, ok := h.Backend().(attachmentStorer)
+	if !ok {
+		return "", fmt.Errorf("backend does not implement attachment storage")
+	}
+	return storer.SaveAttachment(ctx, channel, filename, contentType, file)
+}
+
+// attachmentTypeForContentType maps a MIME type to the coarse attachment
+// kind ("image", "video", "audio" or "document") used in upload responses
+// and inbound message payloads.
+func attachmentTypeForContentType(contentType string) string {
+	switch {
+	case strings.HasPrefix(contentType, "image/"):
+		return "image"
+	case strings.HasPrefix(contentType, "video/"):
+		return "video"
+	case strings.HasPrefix(contentType, "audio/"):
+		return "audio"
+	default:
+		return "document"
+	}
+}
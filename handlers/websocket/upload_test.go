@@ -0,0 +1,22 @@
+package websocket
+
+import "testing"
+
+func TestAttachmentTypeForContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		expected    string
+	}{
+		{"image/jpeg", "image"},
+		{"video/mp4", "video"},
+		{"audio/ogg", "audio"},
+		{"application/pdf", "document"},
+		{"", "document"},
+	}
+
+	for _, tc := range tests {
+		if got := attachmentTypeForContentType(tc.contentType); got != tc.expected {
+			t.Errorf("attachmentTypeForContentType(%q) = %q, expected %q", tc.contentType, got, tc.expected)
+		}
+	}
+}
@@ -10,7 +10,9 @@ import (
 	"github.com/nyaruka/gocommon/urns"
 	"golang.org/x/text/language"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,17 +22,43 @@ func init() {
 
 type handler struct {
 	handlers.BaseHandler
+
+	// conns holds the live WebSocket connection for each URN connected
+	// through the "connect" route, so SendMsg can push to it directly.
+	conns *connRegistry
+
+	// polls tracks clients long-polling the "events" route, and the
+	// backlog SendMsg queues for them when no WebSocket is connected.
+	polls *longPollRegistry
+
+	// streams tracks clients subscribed to the "stream" SSE route.
+	streams *sseRegistry
+
+	// queues holds the outbound retry queue for each channel address,
+	// created lazily the first time SendMsg needs to fall back to HTTP.
+	queuesMu sync.Mutex
+	queues   map[string]*outboundQueue
 }
 
 func newHandler() ChannelHandler {
-	return &handler{handlers.NewBaseHandler(ChannelType("WS"), "WebSocket")}
+	return &handler{
+		BaseHandler: handlers.NewBaseHandler(ChannelType("WS"), "WebSocket"),
+		conns:       newConnRegistry(),
+		polls:       newLongPollRegistry(),
+		streams:     newSSERegistry(),
+		queues:      make(map[string]*outboundQueue),
+	}
 }
 
 // Initialize is called by the engine once everything is loaded
 func (h *handler) Initialize(s Server) error {
 	h.SetServer(s)
-	s.AddHandlerRoute(h, http.MethodPost, "register", h.registerUser)
-	s.AddHandlerRoute(h, http.MethodPost, "receive", h.receiveMessage)
+	s.AddHandlerRoute(h, http.MethodPost, "register", h.withSignatureVerification(h.registerUser))
+	s.AddHandlerRoute(h, http.MethodPost, "receive", h.withSignatureVerification(h.receiveMessage))
+	s.AddHandlerRoute(h, http.MethodGet, "connect", h.withSignatureVerification(h.connect))
+	s.AddHandlerRoute(h, http.MethodGet, "events", h.withSignatureVerification(h.fetchEvents))
+	s.AddHandlerRoute(h, http.MethodGet, "stream", h.withSignatureVerification(h.stream))
+	s.AddHandlerRoute(h, http.MethodPost, "upload", h.withSignatureVerification(h.uploadFile))
 	return nil
 }
 
@@ -47,33 +75,40 @@ func (h *handler) registerUser(ctx context.Context, channel Channel, w http.Resp
 		return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "Ignoring request, no identifier")
 	}
 
-	// the list of data we will return in our response
-	data := make([]interface{}, 0, 2)
+	contact, err := h.processUserPayload(ctx, channel, payload)
+	if err != nil {
+		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, err)
+	}
 
-	// create our URN
-	urn, errURN := urns.NewURNFromParts(channel.Schemes()[0], payload.URN, "", "")
-	if errURN != nil {
-		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, errURN)
+	// build our response
+	data := []interface{}{NewEventRegisteredContactData(contact.UUID())}
+
+	return nil, WriteDataResponse(ctx, w, http.StatusOK, "Events Handled", data)
+}
+
+// processUserPayload creates or fetches the contact for a registration
+// frame and records its language, shared by the HTTP register endpoint
+// and the WebSocket transport.
+func (h *handler) processUserPayload(ctx context.Context, channel Channel, payload *userPayload) (Contact, error) {
+	urn, err := urns.NewURNFromParts(channel.Schemes()[0], payload.URN, "", "")
+	if err != nil {
+		return nil, err
 	}
 
-	contact, errGetContact := h.Backend().GetContact(ctx, channel, urn, "", "")
-	if errGetContact != nil {
-		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, errGetContact)
+	contact, err := h.Backend().GetContact(ctx, channel, urn, "", "")
+	if err != nil {
+		return nil, err
 	}
 
 	// Getting the language in ISO3
 	tag := language.MustParse(payload.Language)
 	languageBase, _ := tag.Base()
 
-	_, errLang := h.Backend().AddLanguageToContact(ctx, channel, languageBase.ISO3(), contact)
-	if errLang != nil {
-		return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, errLang)
+	if _, err := h.Backend().AddLanguageToContact(ctx, channel, languageBase.ISO3(), contact); err != nil {
+		return nil, err
 	}
 
-	// build our response
-	data = append(data, NewEventRegisteredContactData(contact.UUID()))
-
-	return nil, WriteDataResponse(ctx, w, http.StatusOK, "Events Handled", data)
+	return contact, nil
 }
 
 // receiveMessage is our HTTP handler function for incoming messages
@@ -89,6 +124,18 @@ func (h *handler) receiveMessage(ctx context.Context, channel Channel, w http.Re
 		return nil, handlers.WriteAndLogRequestIgnored(ctx, h, channel, w, r, "Ignoring request, no message")
 	}
 
+	events, data, err := h.processMoPayload(ctx, channel, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return events, courier.WriteDataResponse(ctx, w, http.StatusOK, "Events Handled", data)
+}
+
+// processMoPayload writes the incoming messages and acks carried by a
+// moPayload frame, shared by the HTTP receive endpoint and the WebSocket
+// transport.
+func (h *handler) processMoPayload(ctx context.Context, channel Channel, payload *moPayload) ([]courier.Event, []interface{}, error) {
 	// the list of events we deal with
 	events := make([]courier.Event, 0, 2)
 
@@ -107,16 +154,19 @@ func (h *handler) receiveMessage(ctx context.Context, channel Channel, w http.Re
 			contactPhoneNumber := strings.Replace(author, "@c.us", "", 1)
 			urn, errURN := urns.NewWhatsAppURN(contactPhoneNumber)
 			if errURN != nil {
-				return nil, handlers.WriteAndLogRequestError(ctx, h, channel, w, r, errURN)
+				return nil, nil, errURN
 			}
 
 			// build our name from first and last
 			name := handlers.NameFromFirstLastUsername(message.SenderName, "", "")
 
-			// our text is either "text" or "caption" (or empty)
+			// our text is either "text" or "caption" (or empty). attachment
+			// types include those produced by our own upload endpoint, so
+			// message.Body is already a static URL and doesn't need
+			// re-uploading before we store it
 			text := message.Body
 			isAttachment := false
-			if message.Type == "image" {
+			if attachmentTypes[message.Type] {
 				text = message.Caption
 				isAttachment = true
 			}
@@ -131,7 +181,7 @@ func (h *handler) receiveMessage(ctx context.Context, channel Channel, w http.Re
 
 			errMsg := h.Backend().WriteMsg(ctx, event)
 			if errMsg != nil {
-				return nil, errMsg
+				return nil, nil, errMsg
 			}
 
 			h.Backend().WriteExternalIDSeen(event)
@@ -161,34 +211,55 @@ func (h *handler) receiveMessage(ctx context.Context, channel Channel, w http.Re
 		}
 
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		events = append(events, event)
 		data = append(data, courier.NewStatusData(event))
-
 	}
 
-	return events, courier.WriteDataResponse(ctx, w, http.StatusOK, "Events Handled", data)
-
+	return events, data, nil
 }
 
-func (h *handler) sendMsgPart(msg Msg, apiURL string, payload *dataPayload) (string, *ChannelLog, error) {
+// sendMsgPart POSTs payload to apiURL and reports the outcome. It takes
+// just the channel and message ID (not the full Msg) since its caller,
+// the outbound queue's worker, has no Msg for a job reloaded from
+// persisted state after a restart.
+func (h *handler) sendMsgPart(channel Channel, msgID MsgID, apiURL string, payload *dataPayload) (string, int, *ChannelLog, error) {
 	jsonBody, err := json.Marshal(payload)
 	if err != nil {
-		log := NewChannelLog("unable to build JSON body", msg.Channel(), msg.ID(), "", "", NilStatusCode, "", "", time.Duration(0), err)
-		return "", log, err
+		log := NewChannelLog("unable to build JSON body", channel, msgID, "", "", NilStatusCode, "", "", time.Duration(0), err)
+		return "", 0, log, err
 	}
 
 	req, _ := http.NewRequest(http.MethodPost, apiURL, bytes.NewReader(jsonBody))
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept", "application/json")
+
+	// if this channel has a secret configured, sign the request the same
+	// way we verify inbound webhooks, so the gateway can check it back
+	if secret, _ := channel.ConfigForKey(configSecret, "").(string); secret != "" {
+		path := req.URL.Path
+		if req.URL.RawQuery != "" {
+			path += "?" + req.URL.RawQuery
+		}
+
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(handlers.TimestampHeader, timestamp)
+		req.Header.Set(handlers.SignatureHeader, "sha256="+handlers.SignHMACPayload(timestamp, path, jsonBody, secret))
+	}
+
 	rr, err := utils.MakeHTTPRequest(req)
 
 	// build our channel log
-	log := NewChannelLogFromRR("Message Sent", msg.Channel(), msg.ID(), rr).WithError("Message Send Error", err)
+	log := NewChannelLogFromRR("Message Sent", channel, msgID, rr).WithError("Message Send Error", err)
 
-	return "", log, nil
+	statusCode := 0
+	if rr != nil {
+		statusCode = rr.StatusCode
+	}
+
+	return "", statusCode, log, err
 }
 
 // SendMsg sends the passed in message, returning any error
@@ -220,21 +291,46 @@ func (h *handler) SendMsg(ctx context.Context, msg Msg) (MsgStatus, error) {
 	// the status that will be written for this message
 	status := h.Backend().NewMsgStatusForID(msg.Channel(), msg.ID(), MsgErrored)
 
-	// whether we encountered any errors sending any parts
-	hasError := true
+	// push to any SSE subscribers regardless of which transport ends up
+	// delivering the message below
+	h.streams.publish(msg.URN().String(), data)
+
+	// if the destination URN has a live socket, push straight to it and
+	// only fall back to the HTTP address when that fails or isn't open
+	if conn := h.conns.get(msg.URN().String()); conn != nil {
+		err := conn.WriteJSON(data)
+		if err == nil {
+			status.SetStatus(MsgWired)
+			status.AddLog(NewChannelLog("Message Sent", msg.Channel(), msg.ID(), "", "", NilStatusCode, "", "", time.Duration(0), nil))
+			return status, nil
+		}
 
-	// if we have text, send that if we aren't sending it as a caption
-	if msg.Text() != "" {
-		externalID, log, err := h.sendMsgPart(msg, address, data)
-		status.SetExternalID(externalID)
-		hasError = err != nil
-		status.AddLog(log)
+		h.conns.remove(msg.URN().String(), conn)
+		status.AddLog(NewChannelLog("WebSocket Send Error", msg.Channel(), msg.ID(), "", "", NilStatusCode, "", "", time.Duration(0), err))
 	}
 
-	if !hasError {
+	// no live socket: queue it for any client long-polling this URN
+	// instead, falling through to the HTTP POST only if none is waiting
+	if h.polls.enqueue(msg.URN().String(), data) {
 		status.SetStatus(MsgWired)
+		return status, nil
 	}
 
+	// neither transport has a live listener: hand the send off to this
+	// address's outbound queue, which retries with backoff instead of
+	// blocking here on a single HTTP attempt
+	status.SetStatus(MsgQueued)
+	now := time.Now()
+	h.queueFor(address).enqueue(&outboundJob{
+		channel:    msg.Channel(),
+		msgID:      msg.ID(),
+		address:    address,
+		data:       data,
+		priority:   priorityForMsg(msg),
+		nextAt:     now,
+		enqueuedAt: now,
+	})
+
 	return status, nil
 }
 